@@ -0,0 +1,179 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// newRootCmd builds the duplicacy-util command tree. Global flags (-f, -g,
+// -sd, -d, -q, -v) are persistent on the root command so every subcommand
+// inherits them; per-operation flags are local to their own subcommand.
+//
+// Note on flag compatibility: the single-letter flags (-f, -g, -d, -q, -v)
+// are registered as Cobra shorthands and still work with a single dash
+// exactly as before. "-sd" cannot be a shorthand (shorthands are a single
+// rune) and pflag would otherwise parse a bare "-sd" as the clustered
+// shorthands "-s -d", rejecting it outright with "unknown shorthand flag"
+// rather than just deprecating it; rewriteLegacyFlags rewrites "-sd"/"-sd=..."
+// to "--sd"/"--sd=..." before Cobra ever parses argv, so existing cron
+// entries using the single-dash form keep working unchanged.
+func newRootCmd() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:           "duplicacy-util",
+		Short:         "Wrapper around duplicacy for scheduled backup/copy/prune/check jobs",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if jsonLogFlag {
+				logFormat = "json"
+			}
+			if err := selectLogger(); err != nil {
+				return err
+			}
+
+			return prepareGlobalConfig()
+		},
+	}
+
+	rootCmd.PersistentFlags().StringSliceVarP(&cmdConfigs, "config", "f", nil, "Configuration file for storage definitions (must be specified; repeatable or comma-separated)")
+	rootCmd.PersistentFlags().StringVar(&cmdConfigsDir, "configs-dir", "", "Directory of *.yml configuration files to run in addition to -f")
+	rootCmd.PersistentFlags().IntVar(&cmdParallel, "parallel", 1, "How many configs to run at once")
+	rootCmd.PersistentFlags().StringVarP(&cmdGlobalConfig, "global-config", "g", "", "Global configuration file name")
+	rootCmd.PersistentFlags().StringVar(&cmdStorageDir, "sd", "", "Full path to storage directory for configuration/log files")
+
+	rootCmd.PersistentFlags().BoolVarP(&debugFlag, "debug", "d", false, "Enable debug output (implies verbose)")
+	rootCmd.PersistentFlags().BoolVarP(&quietFlag, "quiet", "q", false, "Quiet operations (generate output only in case of error)")
+	rootCmd.PersistentFlags().BoolVarP(&verboseFlag, "verbose", "v", false, "Enable verbose output")
+	rootCmd.PersistentFlags().BoolVarP(&dryRunFlag, "dry-run", "n", false, "Log what would be executed without running any duplicacy command")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", `Log output format: "text" or "json"`)
+	rootCmd.PersistentFlags().BoolVar(&jsonLogFlag, "json", false, "Shorthand for --log-format=json")
+
+	rootCmd.AddCommand(
+		newOperationCmd("backup", "Perform duplicacy backup operation", &cmdBackup),
+		newOperationCmd("copy", "Perform duplicacy copy operation", &cmdCopy),
+		newOperationCmd("prune", "Perform duplicacy prune operation", &cmdPrune),
+		newOperationCmd("check", "Perform duplicacy check operation", &cmdCheck),
+		newOperationCmd("all", "Perform all duplicacy operations (backup, copy, prune, check)", &cmdAll),
+		newListCmd(),
+		newRestoreCmd(),
+		newDaemonCmd(),
+		newValidateCmd(),
+		newTestNotificationsCmd(),
+		newVersionCmd(),
+	)
+
+	return rootCmd
+}
+
+// newOperationCmd builds one of the backup/copy/prune/check/all subcommands.
+// They all share the same shape: set the single operation flag that selects
+// what runOperations performs, then run it against every resolved config (-f,
+// repeated/comma-separated, and/or -configs-dir), at most -parallel at a
+// time. The common case of a single config behaves exactly as before.
+func newOperationCmd(use, short string, selector *bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveLogging()
+
+			configs, err := resolveConfigs()
+			if err != nil {
+				exitCode = 2
+				return err
+			}
+
+			*selector = true
+			if cmdAll {
+				cmdBackup, cmdCopy, cmdPrune, cmdCheck = true, true, true, true
+			}
+
+			if len(configs) == 1 && cmdParallel <= 1 {
+				cmdConfig = configs[0]
+				configFile.setConfig(cmdConfig)
+				if err := configFile.loadConfig(verboseFlag, debugFlag); err != nil {
+					exitCode = 1
+					return nil
+				}
+
+				exitCode = finishRun(runOperations())
+				return nil
+			}
+
+			results := runConfigsInParallel(configs, cmdParallel)
+			logMessage(nil, "Run summary:\n"+summaryTable(results))
+			if err := notifyOfSummary(combinedMailBody(results)); err != nil {
+				logError(nil, fmt.Sprintf("Error: failed to send run summary notification: %s", err))
+			}
+			exitCode = worstStatus(results)
+			return nil
+		},
+	}
+}
+
+func newTestNotificationsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "test-notifications",
+		Short: "Send a test message through every configured notifier",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveLogging()
+
+			if err := testNotifications(); err != nil {
+				exitCode = 1
+				return err
+			}
+
+			exitCode = 0
+			return nil
+		},
+	}
+}
+
+func newVersionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Display version number",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Printf("Version: %s, Git Hash: %s\n", versionText, gitHash)
+			exitCode = 0
+			return nil
+		},
+	}
+}
+
+func newDaemonCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "daemon",
+		Short: "Run as a daemon, dispatching jobs per the configuration file's schedule",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveLogging()
+
+			if status, err := loadRepositoryConfig(); err != nil || status != 0 {
+				exitCode = status
+				return err
+			}
+
+			exitCode = finishRun(runDaemon())
+			return nil
+		},
+	}
+}
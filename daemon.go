@@ -0,0 +1,198 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// scheduledJob associates one configured duplicacy operation (backup, copy,
+// prune or check) with the cron expression that should trigger it and the
+// configuration snapshot it was read from. Snapshot is captured once, at
+// buildScheduler time, so a job that's already running keeps using the
+// configuration it started with even if SIGHUP swaps in a newer one for
+// jobs fired afterwards.
+type scheduledJob struct {
+	config    string
+	operation string
+	cronSpec  string
+	snapshot  *configurationFile
+}
+
+// runDaemon puts duplicacy-util into a long-running mode that reads the
+// "schedule:" block out of the current configuration file and dispatches
+// backup/copy/prune/check runs on the cron schedules found there, instead of
+// running once and exiting. It replaces the external cron/systemd-timer
+// wrapper that most duplicacy-util deployments currently rely on.
+func runDaemon() (int, error) {
+	logMessage(nil, "duplicacy-util starting in daemon mode, version: "+versionText+", Git Hash: "+gitHash)
+
+	scheduler, jobs, err := buildScheduler()
+	if err != nil {
+		return 1, err
+	}
+
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	logScheduledJobs(scheduler, jobs)
+
+	sighup := make(chan os.Signal, 1)
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		select {
+		case <-sighup:
+			logMessage(nil, "Received SIGHUP, re-reading configuration")
+
+			newScheduler, newJobs, err := buildScheduler()
+			if err != nil {
+				logError(nil, fmt.Sprintf("Error: failed to reload configuration, keeping previous schedule: %s", err))
+				continue
+			}
+
+			scheduler.Stop()
+			scheduler = newScheduler
+			jobs = newJobs
+			scheduler.Start()
+			logScheduledJobs(scheduler, jobs)
+
+		case <-sigterm:
+			logMessage(nil, "Received termination signal, waiting for in-flight jobs to finish")
+			ctx := scheduler.Stop()
+			<-ctx.Done()
+			logMessage(nil, "All jobs finished, exiting")
+			return 0, nil
+		}
+	}
+}
+
+// buildScheduler (re-)loads cmdConfig into a fresh, standalone configuration
+// snapshot, reads its "schedule:" block and returns a cron.Cron with one
+// entry registered per scheduled operation. Loading a fresh snapshot rather
+// than mutating the shared configFile is what lets SIGHUP swap in a
+// newly-validated configuration without disturbing a job that's already in
+// flight against the old one.
+func buildScheduler() (*cron.Cron, []scheduledJob, error) {
+	snapshot, err := loadStandaloneConfig(cmdConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load configuration file: %s", err)
+	}
+
+	schedule := snapshot.getSchedule()
+
+	var jobs []scheduledJob
+	scheduler := cron.New()
+
+	for _, entry := range schedule {
+		entry := entry // capture for closure
+
+		job := scheduledJob{
+			config:    cmdConfig,
+			operation: entry.Operation,
+			cronSpec:  entry.CronExpr,
+			snapshot:  snapshot,
+		}
+
+		if _, err := scheduler.AddFunc(entry.CronExpr, func() { runScheduledJob(job) }); err != nil {
+			return nil, nil, fmt.Errorf("invalid schedule %q for operation %q: %s", entry.CronExpr, entry.Operation, err)
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return scheduler, jobs, nil
+}
+
+// runScheduledJob performs a single fired job. It builds a runContext around
+// job's own snapshot and operation instead of mutating the shared
+// cmdConfig/configFile/cmdBackup & friends, so two jobs firing at once (the
+// same entry re-firing before the previous run finished, or two different
+// entries due at the same time) never race on global state; cron.Cron runs
+// each firing in its own goroutine and does not serialize overlapping fires
+// by default. Jobs against the same configuration still never overlap: the
+// per-config flock obtainLockFor takes is not waited on, so a job that fires
+// while another holds it is skipped (status 6200), exactly as a normal
+// single-shot invocation would be.
+func runScheduledJob(job scheduledJob) {
+	logMessageFor(nil, job.config, fmt.Sprintf("Daemon: starting scheduled %s for %s", job.operation, job.config))
+
+	rc := &runContext{
+		config: job.config,
+		cfg:    job.snapshot,
+		dryRun: dryRunFlag,
+	}
+
+	switch job.operation {
+	case "backup":
+		rc.backup = true
+	case "copy":
+		rc.copy = true
+	case "prune":
+		rc.prune = true
+	case "check":
+		rc.check = true
+	default:
+		logErrorFor(nil, job.config, fmt.Sprintf("Daemon: unknown scheduled operation %q, skipping", job.operation))
+		return
+	}
+
+	started := time.Now()
+	returnStatus, err := obtainLockFor(rc)
+	if err != nil {
+		switch returnStatus {
+		case 6200:
+			logErrorFor(nil, job.config, fmt.Sprintf("Warning: %s", err))
+			_ = notifyOfSkip(job.snapshot, job.config)
+		default:
+			logErrorFor(nil, job.config, fmt.Sprintf("Error: %s", err))
+			_ = notifyOfFailure(job.snapshot, job.config)
+		}
+		return
+	}
+
+	activeLogger.Event(LogEvent{
+		Config:     job.config,
+		Operation:  job.operation,
+		DurationMs: time.Since(started).Milliseconds(),
+		Message:    fmt.Sprintf("Daemon: completed scheduled %s for %s", job.operation, job.config),
+	})
+}
+
+// logScheduledJobs writes the next run time of every configured job to the
+// log, so that the startup log doubles as a confirmation that the schedule
+// was parsed as expected.
+func logScheduledJobs(scheduler *cron.Cron, jobs []scheduledJob) {
+	now := time.Now().In(scheduler.Location())
+	for _, job := range jobs {
+		// Entries() is ordered by next run time once the scheduler is
+		// running, not by registration order, so compute each job's next
+		// run from its own spec (cron.New parses with the standard parser)
+		schedule, err := cron.ParseStandard(job.cronSpec)
+		if err != nil {
+			continue
+		}
+		logMessage(nil, fmt.Sprintf("Daemon: scheduled %s for %s (%s), next run at %s",
+			job.operation, job.config, job.cronSpec, schedule.Next(now).Format("2006-01-02 15:04:05")))
+	}
+}
@@ -16,12 +16,12 @@ package main
 
 import (
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -33,19 +33,17 @@ var (
 	cmdGlobalConfig string // Name of the global configuration file (normally "duplicacy-util")
 	cmdStorageDir   string // Base directory for storage of global/repository/log files
 
-	// Binary options for what operations to perform
+	// Binary options for what operations to perform, set by the selected subcommand
 	cmdAll    bool
 	cmdBackup bool
 	cmdCopy   bool
 	cmdCheck  bool
 	cmdPrune  bool
 
-	testNotificationsFlag bool
-
 	debugFlag   bool
 	quietFlag   bool
 	verboseFlag bool
-	versionFlag bool
+	dryRunFlag  bool
 
 	// Version flags (passed by link stage)
 	versionText = "<dev>"
@@ -67,178 +65,322 @@ var (
 
 	// Unit testing active?
 	runningUnitTests bool
-)
-
-func init() {
-	// Perform command line argument processing
-	flag.StringVar(&cmdConfig, "f", "", "Configuration file for storage definitions (must be specified)")
-	flag.StringVar(&cmdGlobalConfig, "g", "", "Global configuration file name")
-	flag.StringVar(&cmdStorageDir, "sd", "", "Full path to storage directory for configuration/log files")
-
-	flag.BoolVar(&cmdAll, "a", false, "Perform all duplicacy operations (backup, copy, purge, check)")
-	flag.BoolVar(&cmdBackup, "backup", false, "Perform duplicacy backup operation")
-	flag.BoolVar(&cmdCopy, "copy", false, "Perform duplicacy copy operation")
-	flag.BoolVar(&cmdCheck, "check", false, "Perform duplicacy check operation")
-	flag.BoolVar(&cmdPrune, "prune", false, "Perform duplicacy prune operation")
 
-	flag.BoolVar(&testNotificationsFlag, "tn", false, "Test notifications")
-
-	flag.BoolVar(&debugFlag, "d", false, "Enable debug output (implies verbose)")
-	flag.BoolVar(&quietFlag, "q", false, "Quiet operations (generate output only in case of error)")
-	flag.BoolVar(&verboseFlag, "v", false, "Enable verbose output")
-	flag.BoolVar(&versionFlag, "version", false, "Display version number")
-}
+	// Exit code to report to the shell once the selected Cobra command has
+	// finished; set by each subcommand's RunE before returning to cobra so that
+	// rootCmd.Execute() callers in main can still os.Exit with the historical
+	// codes (2 for bad args, 5/500/6200 for skipped/failed, etc.)
+	exitCode int
+)
 
 // Generic output routine to generate output to screen (and E-Mail) - Allow output writer
-func logFMessage(w io.Writer, logger *log.Logger, message string) {
+func logFMessage(w io.Writer, logger *log.Logger, config, message string) {
 	if logger != nil {
 		logger.Println(message)
 	}
 
-	text := fmt.Sprint(time.Now().Format("15:04:05"), " ", message)
-	if !loggingSystemDisplayTime {
-		text = message
-	}
-	mailBody = append(mailBody, text)
-
-	if !quietFlag {
-		if w == os.Stdout && loggingSystemDisplayTime {
-			fmt.Fprintln(w, text)
-		} else {
-			// Fatal message shouldn't have time prefix
-			fmt.Fprintln(w, message)
-		}
+	if w == os.Stderr {
+		activeLogger.Error(config, message)
+	} else {
+		activeLogger.Info(config, message)
 	}
 }
 
-// Generic error output routine to generate output to screen (and E-Mail)
+// Generic error output routine to generate output to screen (and E-Mail).
+// Attributed to the global cmdConfig; use logErrorFor when logging on behalf
+// of a specific runContext (e.g. from code that also runs under
+// runConfigsInParallel).
 func logError(logger *log.Logger, message string) {
-	logFMessage(os.Stderr, logger, message)
+	logFMessage(os.Stderr, logger, cmdConfig, message)
 }
 
-// Generic output routine to generate output to screen (and E-Mail)
+// Generic output routine to generate output to screen (and E-Mail).
+// Attributed to the global cmdConfig; use logMessageFor when logging on
+// behalf of a specific runContext (e.g. from code that also runs under
+// runConfigsInParallel).
 func logMessage(logger *log.Logger, message string) {
-	logFMessage(os.Stdout, logger, message)
+	logFMessage(os.Stdout, logger, cmdConfig, message)
 }
 
-func main() {
-	var err error
+// logErrorFor is logError's runContext-aware counterpart: it attributes the
+// line to config instead of the (possibly unrelated, possibly racing) global
+// cmdConfig, so jsonLogger output stays correctly attributed while several
+// configs are running at once.
+func logErrorFor(logger *log.Logger, config, message string) {
+	logFMessage(os.Stderr, logger, config, message)
+}
 
-	// Parse the command line arguments and validate results
-	flag.Parse()
+// logMessageFor is logMessage's runContext-aware counterpart; see logErrorFor.
+func logMessageFor(logger *log.Logger, config, message string) {
+	logFMessage(os.Stdout, logger, config, message)
+}
 
-	// We do minimal command line processing here. Just things we KNOW
-	// won't be supported via automated launching. Otherwise, send off
-	// to processor so we can capture as much as possible via E-Mail
-	// if so configured.
+func main() {
+	rewriteLegacyFlags(os.Args)
+
+	rootCmd := newRootCmd()
 
-	if flag.NArg() != 0 {
-		logError(nil, fmt.Sprint("Error: Unrecognized arguments specified on command line: ", flag.Args()))
-		os.Exit(2)
+	if err := rootCmd.Execute(); err != nil {
+		// The root command silences Cobra's own error output, so report the
+		// error here; preserve the historical "bad arguments" exit code
+		// unless a subcommand already picked a more specific one
+		logError(nil, fmt.Sprintf("Error: %s", err))
+		if exitCode == 0 {
+			exitCode = 2
+		}
 	}
 
-	// If version number was requested, show it and exit
-	if versionFlag {
-		fmt.Printf("Version: %s, Git Hash: %s\n", versionText, gitHash)
-		os.Exit(0)
+	os.Exit(exitCode)
+}
+
+// rewriteLegacyFlags rewrites the one flag that actually broke when this tool
+// moved to Cobra/pflag: "-sd", which pre-dates Cobra and was always a
+// multi-character single-dash flag. pflag treats a leading "-sd" as clustered
+// single-rune shorthands ("-s -d") rather than a long flag, so existing cron
+// entries invoking "-sd /path" would otherwise fail outright with "unknown
+// shorthand flag" instead of just needing a rename. Rewriting "-sd" (and
+// "-sd=...") to "--sd" (and "--sd=...") in argv before Cobra ever sees it
+// keeps those entries working unchanged; every other flag was already a
+// single-rune shorthand and is unaffected.
+func rewriteLegacyFlags(args []string) {
+	for i, arg := range args {
+		switch {
+		case arg == "-sd":
+			args[i] = "--sd"
+		case strings.HasPrefix(arg, "-sd="):
+			args[i] = "-" + arg
+		}
 	}
+}
+
+// prepareGlobalConfig resolves the global storage directory and loads the
+// global configuration file. It is run once, via rootCmd's
+// PersistentPreRunE, before any subcommand executes.
+func prepareGlobalConfig() error {
+	var err error
 
-	// Determine the location of the global storage directory
 	globalStorageDirectory, err = getStorageDirectory(cmdStorageDir)
 	if err != nil {
-		os.Exit(2)
+		return err
 	}
 
-	// Parse the global configuration file, if any
 	if err := loadGlobalConfig(globalStorageDirectory, cmdGlobalConfig); err != nil {
 		quietFlag = false
 		logError(nil, fmt.Sprintf("Error: %s", err))
-		os.Exit(2)
-	}
-
-	// Perform our backup operations
-	returnStatus, err := processArguments()
-	if err != nil {
-		// Note that after this "if" test, err is no longer important;
-		// we'll reuse that for email status to set failure exit code
-		// (even if everything else was successful)
-		switch returnStatus {
-		case 6200:
-			// Notify that the backup process has been skipped
-			logError(nil, fmt.Sprintf("Warning: %s", err))
-			err = notifyOfSkip()
-
-		default:
-			// Notify that the backup process has failed
-			logError(nil, fmt.Sprintf("Error: %s", err))
-			err = notifyOfFailure()
-		}
-
-		if returnStatus == 0 && err != nil {
-			returnStatus = 5
-		}
+		return err
 	}
 
-	os.Exit(returnStatus)
+	return nil
 }
 
-func processArguments() (int, error) {
-
-	if cmdAll {
-		cmdBackup, cmdCopy, cmdPrune, cmdCheck = true, true, true, true
-	}
+// resolveLogging reconciles the -d/-q/-v flags the same way the original
+// flat flag parser did: debug implies verbose, verbose overrides quiet, and
+// quiet is refused outright unless a failure notifier is configured.
+func resolveLogging() {
 	if debugFlag {
 		verboseFlag = true
 	}
 
-	// Verbose overrides quiet
 	if verboseFlag && quietFlag {
 		quietFlag = false
 	}
 
-	// if no failure notifier is defined quiet mode is not allowed
 	if quietFlag && !hasFailureNotifier() {
 		quietFlag = false
 		logError(nil, "Notice: Quiet mode refused; a failure notifier should be configured")
 	}
+}
 
-	// Handle request to test Notifications
-	// if testmailFlag is set; only email notifications will be tested
-	if testNotificationsFlag {
-		if err := testNotifications(); err != nil {
-			return 1, err
-		}
-
-		return 0, nil
+// loadRepositoryConfig requires that -f was specified and loads the
+// corresponding per-repository configuration file.
+func loadRepositoryConfig() (int, error) {
+	configs, err := resolveConfigs()
+	if err != nil {
+		return 2, err
 	}
 
-	if cmdConfig == "" {
-		return 2, errors.New("Mandatory parameter -f is not specified (must be specified)")
+	if len(configs) != 1 {
+		return 2, errors.New("This operation only supports a single -f; use backup/copy/prune/check/all for multiple configs")
 	}
 
-	// Parse the configuration file and check for errors
-	// (Errors are printed to stderr as well as returned)
+	cmdConfig = configs[0]
 	configFile.setConfig(cmdConfig)
 	if err := configFile.loadConfig(verboseFlag, debugFlag); err != nil {
 		return 1, nil
 	}
 
-	// Everything is loaded; make sure we hae something to do
-	if !cmdBackup && !cmdCopy && !cmdPrune && !cmdCheck {
-		return 1, errors.New("No operations to perform (specify -backup, -copy, -prune, -check, or -a (all))")
+	return 0, nil
+}
+
+// runContext threads one run's configuration, selected operations and
+// dry-run flag explicitly through runOperations/obtainLock/finishRun,
+// instead of the package globals those used to read directly. It's what lets
+// runOneConfig run several configs' operations genuinely concurrently
+// without them racing on cmdConfig/configFile/cmdBackup & friends.
+type runContext struct {
+	config string
+	cfg    *configurationFile
+	backup bool
+	copy   bool
+	prune  bool
+	check  bool
+	dryRun bool
+}
+
+// newRunContextFromGlobals captures the current package globals into a
+// runContext. Every call path that predates parallel multi-config execution
+// (the single-config branch of newOperationCmd, list.go, restore.go) keeps
+// going through the globals, so they build a runContext this way and don't
+// need to change.
+func newRunContextFromGlobals() *runContext {
+	return &runContext{
+		config: cmdConfig,
+		cfg:    configFile,
+		backup: cmdBackup,
+		copy:   cmdCopy,
+		prune:  cmdPrune,
+		check:  cmdCheck,
+		dryRun: dryRunFlag,
+	}
+}
+
+// runOperations performs the requested combination of backup/copy/prune/check
+// operations against the already-loaded repository configuration and returns
+// the resulting (status, error) pair; finishRun turns that into the process
+// exit code and sends the skip/failure notification. newOperationCmd has already expanded
+// cmdAll into cmdBackup/cmdCopy/cmdPrune/cmdCheck before this (and before
+// runOneConfig's parallel path) ever runs.
+func runOperations() (int, error) {
+	return runOperationsFor(newRunContextFromGlobals())
+}
+
+// runOperationsFor is the runContext-based core of runOperations; see it for
+// the behavior.
+func runOperationsFor(rc *runContext) (int, error) {
+	logMessageFor(nil, rc.config, fmt.Sprintf("duplicacy-util starting, version: %s, Git Hash: %s", versionText, gitHash))
+
+	if rc.dryRun {
+		logMessageFor(nil, rc.config, fmt.Sprintf("Dry run: operations selected for %s: %s", rc.config, selectedOperationsFor(rc)))
 	}
 
-	// Perform processing. Note that int is returned for two reasons:
-	// 1. We need to know the proper exit code
-	// 2. We want defer statements to execute, so we can't use os.Exit here
+	started := time.Now()
+	status, err := obtainLockFor(rc)
+
+	if rc.dryRun && err == nil {
+		logMessageFor(nil, rc.config, fmt.Sprintf("Dry run: %s would have been performed for %s; no duplicacy command was executed", selectedOperationsFor(rc), rc.config))
+	}
+
+	if err == nil {
+		activeLogger.Event(LogEvent{
+			Config:     rc.config,
+			Operation:  selectedOperationsFor(rc),
+			DurationMs: time.Since(started).Milliseconds(),
+			Message:    fmt.Sprintf("%s completed for %s", selectedOperationsFor(rc), rc.config),
+		})
+	}
+
+	return status, err
+}
+
+// selectedOperations renders the operations selected for this run (backup,
+// copy, prune, check) as a comma-separated list, for use in dry-run logging.
+func selectedOperations() string {
+	return selectedOperationsFor(newRunContextFromGlobals())
+}
+
+// selectedOperationsFor is the runContext-based core of selectedOperations.
+func selectedOperationsFor(rc *runContext) string {
+	var selected []string
+	if rc.backup {
+		selected = append(selected, "backup")
+	}
+	if rc.copy {
+		selected = append(selected, "copy")
+	}
+	if rc.prune {
+		selected = append(selected, "prune")
+	}
+	if rc.check {
+		selected = append(selected, "check")
+	}
+
+	if len(selected) == 0 {
+		return "(none)"
+	}
+
+	return strings.Join(selected, ", ")
+}
+
+// finishRun maps the (returnStatus, err) pair produced by an operation into
+// the process exit code, sending the skip/failure notification E-Mail along
+// the way. This mirrors what main() used to do directly around
+// processArguments before the move to Cobra.
+func finishRun(returnStatus int, err error) int {
+	return finishRunFor(newRunContextFromGlobals(), returnStatus, err)
+}
+
+// finishRunFor is the runContext-based core of finishRun; runOneConfig calls
+// it directly so every config gets its skip/failure notification as soon as
+// it finishes, rather than only the single config finishRun used to see.
+func finishRunFor(rc *runContext, returnStatus int, err error) int {
+	if err != nil {
+		switch returnStatus {
+		case 6200:
+			// Notify that the backup process has been skipped
+			logErrorFor(nil, rc.config, fmt.Sprintf("Warning: %s", err))
+			err = notifyOfSkip(rc.cfg, rc.config)
+
+		default:
+			// Notify that the backup process has failed
+			logErrorFor(nil, rc.config, fmt.Sprintf("Error: %s", err))
+			err = notifyOfFailure(rc.cfg, rc.config)
+		}
+
+		if returnStatus == 0 && err != nil {
+			returnStatus = 5
+		}
+	}
 
-	logMessage(nil, fmt.Sprintf("duplicacy-util starting, version: %s, Git Hash: %s", versionText, gitHash))
-	return obtainLock()
+	return returnStatus
 }
 
 func obtainLock() (int, error) {
-	// Obtain a lock to make sure we don't overlap operations against a configuration
-	lockfile := filepath.Join(globalLockDir, cmdConfig+".lock")
+	return obtainLockFor(newRunContextFromGlobals())
+}
+
+// obtainLockFor is the runContext-based core of obtainLock; see it for the
+// behavior.
+func obtainLockFor(rc *runContext) (int, error) {
+	return withConfigLockFor(rc, func() (int, error) {
+		// performBackup resolves the duplicacy invocation(s) for the selected
+		// operations against rc.cfg; with rc.dryRun set it logs the
+		// fully-resolved argv, working directory and environment for each one
+		// instead of actually running it, the same as restore.go and list.go
+		// do for their own operations. The lock above is still taken and
+		// released either way, so a dry run exercises the same locking path a
+		// real run would.
+		if err := performBackup(rc.cfg, rc.backup, rc.copy, rc.prune, rc.check, rc.dryRun); err != nil {
+			return 500, errors.New("backup failed, check the logs for details")
+		}
+
+		return 0, nil
+	})
+}
+
+// withConfigLock obtains the per-configuration lock used to make sure we
+// don't overlap operations against a configuration, runs fn while holding
+// it, and releases it (and the lock file) before returning - regardless of
+// which operation fn performs. Both scheduled operations and ad-hoc ones
+// like restore go through this so they can never race each other.
+func withConfigLock(fn func() (int, error)) (int, error) {
+	return withConfigLockFor(newRunContextFromGlobals(), fn)
+}
+
+// withConfigLockFor is the runContext-based core of withConfigLock; it locks
+// on rc.config rather than the global cmdConfig, so two runContexts for
+// different configs can hold their locks at the same time.
+func withConfigLockFor(rc *runContext, fn func() (int, error)) (int, error) {
+	lockfile := filepath.Join(globalLockDir, rc.config+".lock")
 	fileLock := flock.New(lockfile)
 
 	locked, err := fileLock.TryLock()
@@ -256,10 +398,5 @@ func obtainLock() (int, error) {
 	defer os.Remove(lockfile)
 	defer fileLock.Unlock()
 
-	// Perform operations (backup or whatever)
-	if err := performBackup(); err != nil {
-		return 500, errors.New("backup failed, check the logs for details")
-	}
-
-	return 0, nil
+	return fn()
 }
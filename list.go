@@ -0,0 +1,89 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var listStorageName string
+
+// newListCmd builds the "list" subcommand, a thin wrapper around
+// `duplicacy list` that lets a user see what revisions are available for a
+// configured storage without having to chdir into the repository and
+// remember duplicacy's own flags.
+func newListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List available revisions for a configured storage",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveLogging()
+
+			if status, err := loadRepositoryConfig(); err != nil || status != 0 {
+				exitCode = status
+				return err
+			}
+
+			exitCode = finishRun(runList())
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&listStorageName, "storage", "", "Storage name to list revisions for (defaults to the storage's default)")
+
+	return cmd
+}
+
+// runList resolves the requested storage against the loaded configuration
+// and passes `duplicacy list` output (collected, and logged once the command
+// has exited) through the same logging path used by the other operations, so
+// it ends up in the notification E-Mail as well.
+func runList() (int, error) {
+	storage, err := configFile.resolveStorage(listStorageName)
+	if err != nil {
+		return 1, err
+	}
+
+	args := []string{"list"}
+	if storage != "" {
+		args = append(args, "-storage", storage)
+	}
+
+	logMessage(nil, fmt.Sprintf("Listing revisions for %s (storage %s)", cmdConfig, storage))
+
+	if dryRunFlag {
+		logMessage(nil, fmt.Sprintf("Dry run: would execute 'duplicacy %s' in %s", strings.Join(args, " "), configFile.repositoryPath()))
+		return 0, nil
+	}
+
+	cmd := exec.Command("duplicacy", args...)
+	cmd.Dir = configFile.repositoryPath()
+
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		logMessage(nil, line)
+	}
+
+	if err != nil {
+		return 500, fmt.Errorf("duplicacy list failed: %s", err)
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,215 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// Emit one JSON object per line instead of plain text (-log-format=json or -json)
+	logFormat   = "text"
+	jsonLogFlag bool
+
+	// activeLogger is the Logger implementation backing logMessage/logError
+	// (and their ...For counterparts) and the LogEvent reports sent through
+	// activeLogger.Event; it's picked from logFormat in newRootCmd's
+	// PersistentPreRunE, before any subcommand has a chance to log anything
+	activeLogger Logger = textLogger{}
+
+	// runBuffersMu guards mailBody and runBuffers below.
+	runBuffersMu sync.Mutex
+
+	// runBuffers holds one mailBody buffer per config currently running
+	// under runOneConfig, keyed by config path. beginMailBuffer/endMailBuffer
+	// manage its lifetime; appendMailBody appends to a config's buffer while
+	// one is open for it, so concurrent configs' log lines can never
+	// interleave into the same notification body. A config with no buffer
+	// open (the single-config, non-parallel path) falls back to the legacy
+	// shared mailBody slice below.
+	runBuffers = map[string][]string{}
+)
+
+// LogEvent carries the structured fields a call site cares about reporting,
+// for consumption by -log-format=json (journald/Loki/Elastic, etc). Message
+// is also what gets shown in text mode, so it should read the same as any
+// other log line.
+type LogEvent struct {
+	Config     string
+	Operation  string
+	Revision   int
+	DurationMs int64
+	Message    string
+}
+
+// Logger is the seam between the rest of duplicacy-util and how a log line
+// actually gets formatted. textLogger reproduces the historical plain-text
+// output byte-for-byte; jsonLogger emits one JSON object per line. Info and
+// Error take the config the line belongs to explicitly (rather than reading
+// the cmdConfig global), so that jsonLogger can attribute every line
+// correctly even while runConfigsInParallel has several configs' operations
+// running at once.
+type Logger interface {
+	Info(config, message string)
+	Error(config, message string)
+	Event(event LogEvent)
+}
+
+// selectLogger switches the active Logger based on the -log-format/-json
+// flags. Called once, from the root command's PersistentPreRunE.
+func selectLogger() error {
+	switch logFormat {
+	case "", "text":
+		activeLogger = textLogger{}
+	case "json":
+		activeLogger = jsonLogger{}
+	default:
+		return fmt.Errorf("unrecognized -log-format %q (expected \"text\" or \"json\")", logFormat)
+	}
+
+	return nil
+}
+
+// appendMailBody records a message for inclusion in config's notification
+// E-Mail, the same way regardless of which Logger is active. If config has a
+// buffer open (via beginMailBuffer), the line goes there; otherwise it falls
+// back to the legacy shared mailBody slice used by the single-config,
+// non-parallel path.
+func appendMailBody(config, message string) {
+	text := fmt.Sprint(time.Now().Format("15:04:05"), " ", message)
+	if !loggingSystemDisplayTime {
+		text = message
+	}
+
+	runBuffersMu.Lock()
+	defer runBuffersMu.Unlock()
+
+	if buf, ok := runBuffers[config]; ok {
+		runBuffers[config] = append(buf, text)
+		return
+	}
+
+	mailBody = append(mailBody, text)
+}
+
+// beginMailBuffer opens a per-config mailBody buffer for config, so that
+// subsequent appendMailBody calls for it accumulate independently of every
+// other config's buffer (and of the legacy shared mailBody slice). Callers
+// must pair it with endMailBuffer once the config's run has finished.
+func beginMailBuffer(config string) {
+	runBuffersMu.Lock()
+	runBuffers[config] = []string{}
+	runBuffersMu.Unlock()
+}
+
+// endMailBuffer closes and returns config's buffer opened by beginMailBuffer.
+func endMailBuffer(config string) []string {
+	runBuffersMu.Lock()
+	defer runBuffersMu.Unlock()
+
+	lines := runBuffers[config]
+	delete(runBuffers, config)
+	return lines
+}
+
+// textLogger reproduces the plain-text output duplicacy-util has always
+// produced, so existing logs and screen-scraping scripts keep working when
+// -log-format isn't specified.
+type textLogger struct{}
+
+func (textLogger) Info(config, message string) {
+	appendMailBody(config, message)
+
+	if !quietFlag {
+		if loggingSystemDisplayTime {
+			fmt.Fprintln(os.Stdout, fmt.Sprint(time.Now().Format("15:04:05"), " ", message))
+		} else {
+			fmt.Fprintln(os.Stdout, message)
+		}
+	}
+}
+
+func (textLogger) Error(config, message string) {
+	appendMailBody(config, message)
+
+	if !quietFlag {
+		// Fatal message shouldn't have time prefix
+		fmt.Fprintln(os.Stderr, message)
+	}
+}
+
+func (t textLogger) Event(event LogEvent) {
+	t.Info(event.Config, event.Message)
+}
+
+// jsonLogger emits one JSON object per line, suitable for piping into
+// journald/Loki/Elastic and alerting on structured fields instead of
+// regex-scraping the text log.
+type jsonLogger struct{}
+
+type jsonLogLine struct {
+	Time       string `json:"ts"`
+	Level      string `json:"level"`
+	Config     string `json:"config,omitempty"`
+	Operation  string `json:"operation,omitempty"`
+	Revision   int    `json:"revision,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Message    string `json:"message"`
+}
+
+func (jsonLogger) Info(config, message string) {
+	emitJSONLine(os.Stdout, jsonLogLine{Level: "info", Config: config, Message: message})
+}
+
+func (jsonLogger) Error(config, message string) {
+	emitJSONLine(os.Stderr, jsonLogLine{Level: "error", Config: config, Message: message})
+}
+
+func (jsonLogger) Event(event LogEvent) {
+	level := "info"
+	w := os.Stdout
+
+	emitJSONLine(w, jsonLogLine{
+		Level:      level,
+		Config:     event.Config,
+		Operation:  event.Operation,
+		Revision:   event.Revision,
+		DurationMs: event.DurationMs,
+		Message:    event.Message,
+	})
+}
+
+func emitJSONLine(w *os.File, line jsonLogLine) {
+	line.Time = time.Now().Format(time.RFC3339)
+	appendMailBody(line.Config, line.Message)
+
+	if quietFlag {
+		return
+	}
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		// Should be unreachable (jsonLogLine only contains marshalable
+		// fields), but fall back to the message rather than lose it
+		fmt.Fprintln(w, line.Message)
+		return
+	}
+
+	fmt.Fprintln(w, string(encoded))
+}
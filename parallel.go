@@ -0,0 +1,227 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// -f, now repeatable and/or comma-separated
+	cmdConfigs []string
+
+	// -configs-dir, a directory of *.yml configuration files to run in addition to -f
+	cmdConfigsDir string
+
+	// -parallel, how many configs to run at once
+	cmdParallel int
+)
+
+// configResult is one config's outcome from runConfigsInParallel: its final
+// exit status (already folded through finishRunFor, so its own skip/failure
+// notification has already been sent), how long it took, and the mailBody
+// lines it produced, captured into its own buffer (see beginMailBuffer) so
+// concurrent configs' log lines can't interleave with one another.
+type configResult struct {
+	config   string
+	status   int
+	elapsed  time.Duration
+	mailBody []string
+}
+
+// resolveConfigs expands -f (repeated and/or comma-separated, courtesy of
+// pflag's StringSliceVar) and -configs-dir into the final, de-duplicated list
+// of configuration files to run.
+func resolveConfigs() ([]string, error) {
+	configs := append([]string{}, cmdConfigs...)
+
+	if cmdConfigsDir != "" {
+		entries, err := os.ReadDir(cmdConfigsDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read -configs-dir %q: %s", cmdConfigsDir, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".yml" {
+				continue
+			}
+			configs = append(configs, filepath.Join(cmdConfigsDir, entry.Name()))
+		}
+	}
+
+	if len(configs) == 0 {
+		return nil, errors.New("Mandatory parameter -f is not specified (must be specified)")
+	}
+
+	sort.Strings(configs)
+	return dedupeStrings(configs), nil
+}
+
+func dedupeStrings(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+
+	for _, v := range in {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// runConfigsInParallel runs the already-selected operation(s) against every
+// config in configs, at most parallelism at a time. Each config gets its own
+// runContext built around a freshly-loaded *configurationFile (see
+// runOneConfig), so distinct configs' duplicacy invocations genuinely run at
+// the same time rather than merely having their goroutines scheduled
+// concurrently; the per-config flock in obtainLockFor still keeps runs
+// against the SAME config from overlapping exactly as before, by skipping
+// (status 6200) the one that finds it already held.
+func runConfigsInParallel(configs []string, parallelism int) []configResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	results := make([]configResult, len(configs))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, config := range configs {
+		i, config := i, config
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = runOneConfig(config)
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runOneConfig loads config into its own *configurationFile and runs it
+// through a runContext built around that snapshot, so concurrent calls from
+// runConfigsInParallel never share mutable state with one another. It calls
+// finishRunFor itself so this config's skip/failure notification is sent as
+// soon as it finishes, rather than the caller having to notice and do it
+// after the fact, and captures its own mailBody buffer so its log lines
+// can't interleave with another concurrently-running config's.
+func runOneConfig(config string) configResult {
+	start := time.Now()
+
+	beginMailBuffer(config)
+
+	cfg := newConfigurationFile()
+	cfg.setConfig(config)
+
+	rc := &runContext{
+		config: config,
+		cfg:    cfg,
+		backup: cmdBackup,
+		copy:   cmdCopy,
+		prune:  cmdPrune,
+		check:  cmdCheck,
+		dryRun: dryRunFlag,
+	}
+
+	var status int
+	if err := cfg.loadConfig(verboseFlag, debugFlag); err != nil {
+		status = finishRunFor(rc, 1, nil)
+	} else {
+		runStatus, runErr := runOperationsFor(rc)
+		status = finishRunFor(rc, runStatus, runErr)
+	}
+
+	return configResult{config: config, status: status, elapsed: time.Since(start), mailBody: endMailBuffer(config)}
+}
+
+// worstStatus returns the worst (highest-severity) status across all
+// configs, which becomes the overall process exit code. A failure outranks
+// a skip (6200), which outranks success; among failures the highest code
+// wins.
+func worstStatus(results []configResult) int {
+	worst := 0
+	for _, r := range results {
+		switch {
+		case r.status == 0:
+		case r.status == 6200:
+			if worst == 0 {
+				worst = r.status
+			}
+		default:
+			if worst == 0 || worst == 6200 || r.status > worst {
+				worst = r.status
+			}
+		}
+	}
+	return worst
+}
+
+// summaryTable renders the per-config success/skip/fail table that heads the
+// notification E-Mail (see combinedMailBody) of a run that goes through
+// runConfigsInParallel.
+func summaryTable(results []configResult) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "Config                                   Status    Elapsed")
+	for _, r := range results {
+		fmt.Fprintf(&b, "%-40s %-9s %s\n", r.config, statusLabel(r), r.elapsed.Round(time.Millisecond))
+	}
+
+	return b.String()
+}
+
+// combinedMailBody assembles the single notification body sent for a
+// multi-config run: the summary table, followed by each config's own
+// mailBody lines under its own heading, in the order the configs were run.
+func combinedMailBody(results []configResult) string {
+	var b strings.Builder
+
+	fmt.Fprint(&b, summaryTable(results))
+
+	for _, r := range results {
+		fmt.Fprintf(&b, "\n--- %s ---\n", r.config)
+		for _, line := range r.mailBody {
+			fmt.Fprintln(&b, line)
+		}
+	}
+
+	return b.String()
+}
+
+func statusLabel(r configResult) string {
+	switch {
+	case r.status == 0:
+		return "success"
+	case r.status == 6200:
+		return "skipped"
+	default:
+		return "failed"
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018 Jeff Coffler <jeff@taltos.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreRevision int
+	restoreTime     string
+	restoreStorage  string
+	restoreTo       string
+	restoreInclude  []string
+	restoreExclude  []string
+)
+
+// newRestoreCmd builds the "restore" subcommand. It wraps `duplicacy
+// restore`, letting the caller pick either an explicit revision (-r) or a
+// point in time (-t, resolved to the closest revision via `duplicacy list`),
+// and goes through the same obtainLock path as backup/copy/prune/check so a
+// restore can't race a scheduled job against the same configuration.
+func newRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore files from a backup storage",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveLogging()
+
+			if status, err := loadRepositoryConfig(); err != nil || status != 0 {
+				exitCode = status
+				return err
+			}
+
+			exitCode = finishRun(obtainRestoreLock())
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVarP(&restoreRevision, "revision", "r", 0, "Revision number to restore (mutually exclusive with -t)")
+	cmd.Flags().StringVarP(&restoreTime, "time", "t", "", "RFC3339 timestamp to restore as of, resolved to the closest revision (mutually exclusive with -r)")
+	cmd.Flags().StringVar(&restoreStorage, "storage", "", "Storage name to restore from (defaults to the storage's default)")
+	cmd.Flags().StringVar(&restoreTo, "to", "", "Target directory to restore into (must be specified)")
+	cmd.Flags().StringSliceVar(&restoreInclude, "include", nil, "Pattern to include (may be repeated)")
+	cmd.Flags().StringSliceVar(&restoreExclude, "exclude", nil, "Pattern to exclude (may be repeated)")
+
+	return cmd
+}
+
+// obtainRestoreLock takes the same per-configuration lock used by
+// backup/copy/prune/check before performing the restore, so a restore can
+// never run concurrently with a scheduled job against the same repository.
+func obtainRestoreLock() (int, error) {
+	return withConfigLock(func() (int, error) {
+		if err := performRestore(); err != nil {
+			return 500, err
+		}
+
+		return 0, nil
+	})
+}
+
+// performRestore resolves the requested revision (translating -t to the
+// closest revision via `duplicacy list` when needed), builds the
+// corresponding `duplicacy restore` invocation and runs it, passing its
+// output (collected, and logged once the command has exited) through
+// logFMessage so it ends up in the notification E-Mail like any other
+// operation.
+func performRestore() error {
+	if restoreTo == "" {
+		return errors.New("Mandatory parameter -to is not specified (must be specified)")
+	}
+
+	if restoreRevision != 0 && restoreTime != "" {
+		return errors.New("-r and -t are mutually exclusive")
+	}
+
+	revision := restoreRevision
+	if restoreTime != "" {
+		resolved, err := resolveRevisionForTime(restoreTime)
+		if err != nil {
+			return err
+		}
+		revision = resolved
+	}
+
+	if revision == 0 {
+		return errors.New("Either -r or -t must be specified to select a revision to restore")
+	}
+
+	storage, err := configFile.resolveStorage(restoreStorage)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"restore", "-r", strconv.Itoa(revision)}
+	if storage != "" {
+		args = append(args, "-storage", storage)
+	}
+	for _, pattern := range restoreInclude {
+		args = append(args, "-include", pattern)
+	}
+	for _, pattern := range restoreExclude {
+		args = append(args, "-exclude", pattern)
+	}
+
+	if dryRunFlag {
+		logMessage(nil, fmt.Sprintf("Dry run: would execute 'duplicacy %s' in %s",
+			strings.Join(args, " "), restoreTo))
+		return nil
+	}
+
+	logMessage(nil, fmt.Sprintf("Restoring revision %d into %s", revision, restoreTo))
+
+	cmd := exec.Command("duplicacy", args...)
+	cmd.Dir = restoreTo
+
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		logMessage(nil, line)
+	}
+
+	if err != nil {
+		return fmt.Errorf("duplicacy restore failed: %s", err)
+	}
+
+	return nil
+}
+
+// resolveRevisionForTime runs `duplicacy list` and picks the most recent
+// revision at or before the requested timestamp.
+func resolveRevisionForTime(rfc3339 string) (int, error) {
+	requested, err := time.Parse(time.RFC3339, rfc3339)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -t timestamp %q: %s", rfc3339, err)
+	}
+
+	revisions, err := configFile.listRevisions(restoreStorage)
+	if err != nil {
+		return 0, err
+	}
+
+	var best int
+	for _, rev := range revisions {
+		if !rev.Created.After(requested) && rev.Number > best {
+			best = rev.Number
+		}
+	}
+
+	if best == 0 {
+		return 0, fmt.Errorf("no revision found at or before %s", rfc3339)
+	}
+
+	return best, nil
+}